@@ -0,0 +1,487 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/internal/flowcontrol"
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+	"github.com/lucas-clemente/quic-go/internal/utils"
+	"github.com/lucas-clemente/quic-go/internal/wire"
+)
+
+// A ReceiveStream is the readable side of a stream.
+// A unidirectional stream opened by the peer implements only this interface.
+type ReceiveStream interface {
+	StreamID() protocol.StreamID
+	// Read blocks until data is available, the receive side is closed remotely, reset,
+	// or cancelled, or the read deadline expires. It returns as soon as it has read some
+	// data and no more is buffered, so p is not necessarily filled.
+	Read(p []byte) (int, error)
+	// ReadContext behaves like Read, but additionally aborts (returning ctx.Err()) as soon
+	// as ctx is done. It lets callers propagate an external cancellation, e.g. from an
+	// incoming HTTP request, down into QUIC I/O without racing SetReadDeadline.
+	ReadContext(ctx context.Context, p []byte) (int, error)
+	// ReadFrame returns the next chunk of stream data, together with a bool indicating
+	// whether it is the final chunk (the FIN was received).
+	// For a non-final chunk, the returned slice aliases the packet buffer it was
+	// received in without copying, and stays valid until the next call to ReadFrame,
+	// which releases it back to the receive buffer pool (Read doesn't release it). The
+	// final chunk (fin == true, err == io.EOF) has no such next call to release its
+	// buffer on, so it is copied instead of aliased: it remains valid for as long as
+	// the caller holds onto it.
+	// Read and ReadFrame must not be called concurrently.
+	ReadFrame() (data []byte, fin bool, err error)
+	CancelRead(errorCode uint64) error
+	SetReadDeadline(t time.Time) error
+}
+
+// receiveStreamI is the interface the session and the streams map use to
+// interact with the receiving half of a stream.
+type receiveStreamI interface {
+	ReceiveStream
+
+	AddStreamFrame(*wire.StreamFrame) error
+	handleRstStreamFrame(*wire.RstStreamFrame) error
+	// RegisterRemoteError is kept for callers that have not migrated to handleRstStreamFrame yet.
+	//
+	// Deprecated: use handleRstStreamFrame instead.
+	RegisterRemoteError(error, protocol.ByteCount) error
+	Cancel(error)
+	GetWindowUpdate() protocol.ByteCount
+}
+
+// receiveStream is the implementation of the receiving half of a stream.
+// It used to be the "reading" parts of the monolithic stream type, and is
+// now also used directly by unidirectional receive streams.
+type receiveStream struct {
+	mutex sync.Mutex
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	streamID protocol.StreamID
+	onData   func()
+	// onStopSending is a callback that should send a STOP_SENDING frame
+	onStopSending func(protocol.StreamID, uint64)
+
+	readPosInFrame int
+	readOffset     protocol.ByteCount
+
+	// Once set, the errors must not be changed!
+	err error
+
+	// cancelled is set when Cancel() is called
+	cancelled utils.AtomicBool
+	// finishedReading is set once we read a frame with a FinBit
+	finishedReading utils.AtomicBool
+	// resetRemotely is set if RegisterRemoteError() is called
+	resetRemotely utils.AtomicBool
+
+	frameQueue   *streamFrameSorter
+	readChan     chan struct{}
+	readDeadline time.Time
+
+	// pendingRelease returns the buffer of the frame most recently handed out by
+	// ReadFrame to the receive buffer pool. It is only safe to call once the caller is
+	// known to be done with that buffer, i.e. right before the next frame is handed out.
+	pendingRelease func()
+
+	flowController flowcontrol.StreamFlowController
+	version        protocol.VersionNumber
+}
+
+var _ ReceiveStream = &receiveStream{}
+var _ receiveStreamI = &receiveStream{}
+
+func newReceiveStream(
+	streamID protocol.StreamID,
+	onData func(),
+	onStopSending func(protocol.StreamID, uint64),
+	flowController flowcontrol.StreamFlowController,
+	version protocol.VersionNumber,
+	ctx context.Context,
+	ctxCancel context.CancelFunc,
+) *receiveStream {
+	return &receiveStream{
+		onData:         onData,
+		onStopSending:  onStopSending,
+		streamID:       streamID,
+		flowController: flowController,
+		frameQueue:     newStreamFrameSorter(),
+		readChan:       make(chan struct{}, 1),
+		version:        version,
+		ctx:            ctx,
+		ctxCancel:      ctxCancel,
+	}
+}
+
+func (s *receiveStream) StreamID() protocol.StreamID {
+	return s.streamID
+}
+
+// Read implements io.Reader. It is not thread safe!
+func (s *receiveStream) Read(p []byte) (int, error) {
+	return s.readImpl(s.ctx, p)
+}
+
+// ReadContext behaves like Read, but additionally unblocks as soon as ctx is done.
+func (s *receiveStream) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if ctx.Done() == nil {
+		return s.readImpl(s.ctx, p)
+	}
+	mergedCtx, cancel := mergeContexts(s.ctx, ctx)
+	defer cancel()
+	n, err := s.readImpl(mergedCtx, p)
+	if err == mergedCtx.Err() && s.ctx.Err() == nil {
+		// the external ctx, not the stream's own context, is what unblocked us
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+func (s *receiveStream) readImpl(ctx context.Context, p []byte) (int, error) {
+	s.mutex.Lock()
+	err := s.err
+	s.mutex.Unlock()
+	if s.cancelled.Get() {
+		return 0, err
+	}
+	if s.finishedReading.Get() {
+		return 0, io.EOF
+	}
+
+	bytesRead := 0
+	for bytesRead < len(p) {
+		s.mutex.Lock()
+		frame := s.frameQueue.Head()
+		if frame == nil && bytesRead > 0 {
+			err = s.err
+			s.mutex.Unlock()
+			return bytesRead, err
+		}
+
+		var err error
+		for {
+			// Stop waiting on errors (including a *StreamError set by CancelRead or a RST_STREAM)
+			if s.cancelled.Get() || s.err != nil {
+				err = s.err
+				break
+			}
+
+			deadline := s.readDeadline
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				err = errDeadline
+				break
+			}
+
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+				break
+			}
+
+			if frame != nil {
+				s.readPosInFrame = int(s.readOffset - frame.Offset)
+				break
+			}
+
+			s.mutex.Unlock()
+			if deadline.IsZero() {
+				select {
+				case <-s.readChan:
+				case <-ctx.Done():
+				}
+			} else {
+				select {
+				case <-s.readChan:
+				case <-ctx.Done():
+				case <-time.After(deadline.Sub(time.Now())):
+				}
+			}
+			s.mutex.Lock()
+			frame = s.frameQueue.Head()
+		}
+		s.mutex.Unlock()
+
+		if err != nil {
+			return bytesRead, err
+		}
+
+		m := utils.Min(len(p)-bytesRead, int(frame.DataLen())-s.readPosInFrame)
+
+		if bytesRead > len(p) {
+			return bytesRead, fmt.Errorf("BUG: bytesRead (%d) > len(p) (%d) in receiveStream.Read", bytesRead, len(p))
+		}
+		if s.readPosInFrame > int(frame.DataLen()) {
+			return bytesRead, fmt.Errorf("BUG: readPosInFrame (%d) > frame.DataLen (%d) in receiveStream.Read", s.readPosInFrame, frame.DataLen())
+		}
+		copy(p[bytesRead:], frame.Data[s.readPosInFrame:])
+
+		s.readPosInFrame += m
+		bytesRead += m
+		s.readOffset += protocol.ByteCount(m)
+
+		// when a RST_STREAM was received, the flow controller was already informed about the final byteOffset for this stream
+		if !s.resetRemotely.Get() {
+			s.flowController.AddBytesRead(protocol.ByteCount(m))
+		}
+		s.onData() // so that a possible WINDOW_UPDATE is sent
+
+		if s.readPosInFrame >= int(frame.DataLen()) {
+			fin := frame.FinBit
+			s.mutex.Lock()
+			s.frameQueue.Pop()
+			s.mutex.Unlock()
+			// the data has already been copied into p, so the buffer can be released right away
+			putBackFrame(frame)
+			if fin {
+				s.finishedReading.Set(true)
+				// the receive side is now definitively closed, not just remotely
+				// reset or cancelled; cancel ctx so it's done in this case too, and
+				// so that anyone merging it into a larger context (e.g. the
+				// bidirectional stream's Context()) isn't left waiting on a
+				// context that will otherwise never fire.
+				s.ctxCancel()
+				return bytesRead, io.EOF
+			}
+		}
+	}
+
+	return bytesRead, nil
+}
+
+// ReadFrame returns the next chunk of stream data without copying it. See the doc comment
+// on the ReceiveStream interface for the lifetime of the returned slice.
+func (s *receiveStream) ReadFrame() ([]byte, bool, error) {
+	s.mutex.Lock()
+	// the previous chunk has been handed off to (and presumably consumed by) the caller;
+	// it's now safe to release its buffer back to the pool.
+	release := s.pendingRelease
+	s.pendingRelease = nil
+	s.mutex.Unlock()
+	if release != nil {
+		release()
+	}
+
+	s.mutex.Lock()
+	err := s.err
+	s.mutex.Unlock()
+	if s.cancelled.Get() {
+		return nil, false, err
+	}
+	if s.finishedReading.Get() {
+		return nil, false, io.EOF
+	}
+
+	s.mutex.Lock()
+	frame := s.frameQueue.Head()
+	for {
+		if s.cancelled.Get() || s.err != nil {
+			err = s.err
+			break
+		}
+		deadline := s.readDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			err = errDeadline
+			break
+		}
+		if frame != nil {
+			err = nil
+			break
+		}
+		s.mutex.Unlock()
+		if deadline.IsZero() {
+			<-s.readChan
+		} else {
+			select {
+			case <-s.readChan:
+			case <-time.After(deadline.Sub(time.Now())):
+			}
+		}
+		s.mutex.Lock()
+		frame = s.frameQueue.Head()
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	readPosInFrame := int(s.readOffset - frame.Offset)
+	chunk := frame.Data[readPosInFrame:]
+	fin := frame.FinBit
+
+	s.mutex.Lock()
+	s.readOffset += protocol.ByteCount(len(chunk))
+	s.frameQueue.Pop()
+	if !fin {
+		// the caller now owns chunk; only release the frame's buffer on the next call
+		s.pendingRelease = func() { putBackFrame(frame) }
+	}
+	s.mutex.Unlock()
+
+	if !s.resetRemotely.Get() {
+		s.flowController.AddBytesRead(protocol.ByteCount(len(chunk)))
+	}
+	s.onData()
+
+	if fin {
+		s.finishedReading.Set(true)
+		s.ctxCancel()
+		// io.EOF tells the caller not to call ReadFrame again, so there's no
+		// later call to defer releasing this buffer to. But the buffer can't be
+		// released here either: chunk still aliases it, and the caller hasn't
+		// had a chance to read chunk yet, so releasing now would let a
+		// concurrent packet-receive goroutine overwrite it from under them.
+		// Copy the data out instead: it's the last chunk of the stream, so
+		// this one allocation is the price of not deferring the release to a
+		// call the caller is never going to make.
+		final := make([]byte, len(chunk))
+		copy(final, chunk)
+		putBackFrame(frame)
+		return final, true, io.EOF
+	}
+	return chunk, false, nil
+}
+
+// putBackFrame returns a frame's underlying packet buffer to the receive buffer pool it
+// was allocated from, if it was pooled at all (synthetic frames, e.g. the virtual FIN
+// created by CloseRemote, are not).
+func putBackFrame(frame *wire.StreamFrame) {
+	if frame != nil && frame.PutBack != nil {
+		frame.PutBack()
+	}
+}
+
+// AddStreamFrame adds a new stream frame
+func (s *receiveStream) AddStreamFrame(frame *wire.StreamFrame) error {
+	maxOffset := frame.Offset + frame.DataLen()
+	if err := s.flowController.UpdateHighestReceived(maxOffset, frame.FinBit); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.frameQueue.Push(frame); err != nil && err != errDuplicateStreamData {
+		return err
+	}
+	s.signalRead()
+	return nil
+}
+
+// signalRead performs a non-blocking send on the readChan
+func (s *receiveStream) signalRead() {
+	select {
+	case s.readChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *receiveStream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	oldDeadline := s.readDeadline
+	s.readDeadline = t
+	s.mutex.Unlock()
+	// if the new deadline is before the currently set deadline, wake up Read()
+	if t.Before(oldDeadline) {
+		s.signalRead()
+	}
+	return nil
+}
+
+// CloseRemote makes the stream receive a "virtual" FIN stream frame at a given offset
+func (s *receiveStream) CloseRemote(offset protocol.ByteCount) {
+	s.AddStreamFrame(&wire.StreamFrame{FinBit: true, Offset: offset})
+}
+
+// Cancel is called by the session to indicate that an error occurred
+// The stream will be closed immediately.
+func (s *receiveStream) Cancel(err error) {
+	s.mutex.Lock()
+	s.cancelled.Set(true)
+	s.ctxCancel()
+	// errors must not be changed!
+	if s.err == nil {
+		s.err = err
+		s.signalRead()
+	}
+	s.mutex.Unlock()
+}
+
+// CancelRead aborts receiving on this stream.
+// It discards any data that has already been buffered, and asks the sender
+// to stop transmitting stream data by sending a STOP_SENDING frame.
+func (s *receiveStream) CancelRead(errorCode uint64) error {
+	s.mutex.Lock()
+	if s.finishedReading.Get() || s.err != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.err = &StreamError{StreamID: s.streamID, ErrorCode: errorCode, Remote: false}
+	// Deliberately not releasing pendingRelease here: it's the buffer behind the chunk
+	// from the most recent ReadFrame call, which (per ReadFrame's doc comment) stays
+	// valid until the *next* ReadFrame call. CancelRead is meant to be callable from
+	// another goroutine while that chunk is still being consumed, so releasing it here
+	// would race with that consumer. It's released the usual way, by a later ReadFrame
+	// call; if the caller never makes one, the buffer is reclaimed by the GC instead.
+	//
+	// discard any frames that are already buffered, returning their buffers to the
+	// receive buffer pool immediately instead of waiting to be garbage collected
+	for frame := s.frameQueue.Head(); frame != nil; frame = s.frameQueue.Head() {
+		s.frameQueue.Pop()
+		putBackFrame(frame)
+	}
+	s.frameQueue = newStreamFrameSorter()
+	s.ctxCancel()
+	s.signalRead()
+	s.mutex.Unlock()
+	s.onStopSending(s.streamID, errorCode)
+	return nil
+}
+
+// handleRstStreamFrame is called when a RST_STREAM frame is received for this stream.
+// It records the peer's application error code so that Read returns a *StreamError carrying it.
+func (s *receiveStream) handleRstStreamFrame(frame *wire.RstStreamFrame) error {
+	return s.registerRemoteError(frame.ErrorCode, frame.FinalOffset)
+}
+
+func (s *receiveStream) registerRemoteError(errorCode uint64, offset protocol.ByteCount) error {
+	if s.resetRemotely.Get() {
+		return nil
+	}
+	s.mutex.Lock()
+	s.resetRemotely.Set(true)
+	s.ctxCancel()
+	// errors must not be changed!
+	if s.err == nil {
+		s.err = &StreamError{StreamID: s.streamID, ErrorCode: errorCode, Remote: true}
+		s.signalRead()
+	}
+	if err := s.flowController.UpdateHighestReceived(offset, true); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+// RegisterRemoteError is called when a RST_STREAM is received for this stream.
+//
+// Deprecated: use handleRstStreamFrame instead, which also carries the peer's application error code.
+func (s *receiveStream) RegisterRemoteError(err error, offset protocol.ByteCount) error {
+	return s.registerRemoteError(0, offset)
+}
+
+func (s *receiveStream) GetWindowUpdate() protocol.ByteCount {
+	return s.flowController.GetWindowUpdate()
+}
+
+// SetReadOffset sets the read offset.
+// It is only needed for the crypto stream.
+// It must not be called concurrently with any other stream methods, especially Read.
+func (s *receiveStream) SetReadOffset(offset protocol.ByteCount) {
+	s.readOffset = offset
+	s.frameQueue.readPosition = offset
+}
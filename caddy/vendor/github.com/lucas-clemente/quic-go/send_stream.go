@@ -0,0 +1,531 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/internal/flowcontrol"
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+	"github.com/lucas-clemente/quic-go/internal/utils"
+	"github.com/lucas-clemente/quic-go/internal/wire"
+)
+
+// A SendStream is the writable side of a stream.
+// A unidirectional stream opened by this endpoint implements only this interface.
+type SendStream interface {
+	StreamID() protocol.StreamID
+	// Write blocks until p has been fully written, the stream's Context is done
+	// (it was closed, reset, or cancelled), or the write deadline expires.
+	Write(p []byte) (int, error)
+	// WriteContext behaves like Write, but additionally aborts (returning ctx.Err())
+	// as soon as ctx is done. It lets callers propagate an external cancellation,
+	// e.g. from an incoming HTTP request, down into QUIC I/O without racing
+	// SetWriteDeadline.
+	WriteContext(ctx context.Context, p []byte) (int, error)
+	// Close closes the write-side of the stream. It blocks until the peer has
+	// acknowledged the final STREAM frame carrying the FIN, the stream is
+	// reset or cancelled, or the stream's Context or write deadline expires.
+	// Use CloseAsync if that blocking behavior is not wanted.
+	Close() error
+	CloseAsync() error
+	CancelWrite(errorCode uint64) error
+	// Reset is kept for callers that have not migrated to CancelWrite yet. It always sends error code 0.
+	//
+	// Deprecated: use CancelWrite instead.
+	Reset(err error)
+	Context() context.Context
+	SetWriteDeadline(t time.Time) error
+}
+
+// sendStreamI is the interface the session and the streams map use to
+// interact with the sending half of a stream.
+type sendStreamI interface {
+	SendStream
+
+	HasDataForWriting() bool
+	GetDataForWriting(maxBytes protocol.ByteCount) (data []byte, shouldSendFin bool)
+	// popStreamFrame returns the next STREAM frame to send on this stream, preferring
+	// frames queued by onLoss over new data.
+	popStreamFrame(maxBytes protocol.ByteCount) *wire.StreamFrame
+	GetWriteOffset() protocol.ByteCount
+	Finished() bool
+	Cancel(error)
+	UpdateSendWindow(protocol.ByteCount)
+	IsFlowControlBlocked() bool
+	// handleStopSendingFrame is the session's entry point for dispatching an
+	// inbound STOP_SENDING frame to this stream.
+	handleStopSendingFrame(*wire.StopSendingFrame)
+	// onStreamFrameAcked is the ack handler's entry point for reporting that a
+	// STREAM frame sent on this stream has been acknowledged by the peer.
+	onStreamFrameAcked(*wire.StreamFrame)
+	// onLoss is the ack handler's entry point for reporting that a STREAM frame sent on
+	// this stream was lost and needs to be retransmitted.
+	onLoss(*wire.StreamFrame)
+}
+
+// sendStream is the implementation of the sending half of a stream.
+// It used to be the "writing" parts of the monolithic stream type, and is
+// now also used directly by unidirectional send streams.
+type sendStream struct {
+	mutex sync.Mutex
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	streamID protocol.StreamID
+	onData   func()
+	// onReset is a callback that should send a RST_STREAM carrying the given application error code
+	onReset func(protocol.StreamID, uint64, protocol.ByteCount)
+
+	writeOffset protocol.ByteCount
+
+	// Once set, the errors must not be changed!
+	err error
+
+	// cancelled is set when Cancel() is called
+	cancelled utils.AtomicBool
+	// finishedWriting is set once Close() is called
+	finishedWriting utils.AtomicBool
+	// resetLocally is set if CancelWrite() is called
+	resetLocally utils.AtomicBool
+
+	dataForWriting []byte
+	finSent        utils.AtomicBool
+	rstSent        utils.AtomicBool
+	writeChan      chan struct{}
+	writeDeadline  time.Time
+
+	// doneSending is closed once the packet carrying the final STREAM frame
+	// (the one with the FIN bit set) has been acknowledged by the peer.
+	// Close() blocks on it.
+	doneSending     chan struct{}
+	doneSendingOnce sync.Once
+
+	// retransmissionQueue holds STREAM frames that were sent but later reported lost by onLoss.
+	// popStreamFrame prefers these over new data, in order.
+	retransmissionQueue []*wire.StreamFrame
+	// numOutstandingFrames counts frames (including the FIN frame) that have been popped by
+	// popStreamFrame but neither acked (onStreamFrameAcked) nor reported lost (onLoss) yet.
+	numOutstandingFrames int
+
+	flowController flowcontrol.StreamFlowController
+	version        protocol.VersionNumber
+}
+
+var _ SendStream = &sendStream{}
+var _ sendStreamI = &sendStream{}
+
+func newSendStream(
+	streamID protocol.StreamID,
+	onData func(),
+	onReset func(protocol.StreamID, uint64, protocol.ByteCount),
+	flowController flowcontrol.StreamFlowController,
+	version protocol.VersionNumber,
+	ctx context.Context,
+	ctxCancel context.CancelFunc,
+) *sendStream {
+	return &sendStream{
+		onData:         onData,
+		onReset:        onReset,
+		streamID:       streamID,
+		flowController: flowController,
+		writeChan:      make(chan struct{}, 1),
+		doneSending:    make(chan struct{}),
+		version:        version,
+		ctx:            ctx,
+		ctxCancel:      ctxCancel,
+	}
+}
+
+func (s *sendStream) StreamID() protocol.StreamID {
+	return s.streamID
+}
+
+func (s *sendStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sendStream) Write(p []byte) (int, error) {
+	return s.writeImpl(s.ctx, p)
+}
+
+// WriteContext behaves like Write, but additionally unblocks as soon as ctx is done.
+func (s *sendStream) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if ctx.Done() == nil {
+		return s.writeImpl(s.ctx, p)
+	}
+	mergedCtx, cancel := mergeContexts(s.ctx, ctx)
+	defer cancel()
+	n, err := s.writeImpl(mergedCtx, p)
+	if err == mergedCtx.Err() && s.ctx.Err() == nil {
+		// the external ctx, not the stream's own context, is what unblocked us
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+func (s *sendStream) writeImpl(ctx context.Context, p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.resetLocally.Get() || s.err != nil {
+		return 0, s.err
+	}
+	if s.finishedWriting.Get() {
+		return 0, fmt.Errorf("write on closed stream %d", s.streamID)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	s.dataForWriting = make([]byte, len(p))
+	copy(s.dataForWriting, p)
+	s.onData()
+
+	var err error
+	for {
+		deadline := s.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			err = errDeadline
+			break
+		}
+		if s.dataForWriting == nil || s.err != nil {
+			break
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+
+		s.mutex.Unlock()
+		if deadline.IsZero() {
+			select {
+			case <-s.writeChan:
+			case <-ctx.Done():
+			}
+		} else {
+			select {
+			case <-s.writeChan:
+			case <-ctx.Done():
+			case <-time.After(deadline.Sub(time.Now())):
+			}
+		}
+		s.mutex.Lock()
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	if s.err != nil {
+		return len(p) - len(s.dataForWriting), s.err
+	}
+	return len(p), nil
+}
+
+func (s *sendStream) GetWriteOffset() protocol.ByteCount {
+	return s.writeOffset
+}
+
+// HasDataForWriting says if there's stream available to be dequeued for writing
+func (s *sendStream) HasDataForWriting() bool {
+	s.mutex.Lock()
+	hasData := s.err == nil && // nothing should be sent if an error occurred
+		(len(s.retransmissionQueue) > 0 || // a previously lost frame needs to be resent
+			len(s.dataForWriting) > 0 || // there is data queued for sending
+			s.finishedWriting.Get() && !s.finSent.Get()) // if there is no data, but writing finished and the FIN hasn't been sent yet
+	s.mutex.Unlock()
+	return hasData
+}
+
+func (s *sendStream) GetDataForWriting(maxBytes protocol.ByteCount) ([]byte, bool /* should send FIN */) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, shouldSendFin := s.getDataForWritingLocked(maxBytes)
+	if shouldSendFin {
+		s.finSent.Set(true)
+	}
+	return data, shouldSendFin
+}
+
+// getDataForWritingLocked assumes that s.mutex is already held.
+func (s *sendStream) getDataForWritingLocked(maxBytes protocol.ByteCount) ([]byte, bool /* should send FIN */) {
+	if s.err != nil || s.dataForWriting == nil {
+		return nil, s.finishedWriting.Get() && !s.finSent.Get()
+	}
+
+	// TODO(#657): Flow control for the crypto stream
+	if s.streamID != s.version.CryptoStreamID() {
+		maxBytes = utils.MinByteCount(maxBytes, s.flowController.SendWindowSize())
+	}
+	if maxBytes == 0 {
+		return nil, false
+	}
+
+	var ret []byte
+	if protocol.ByteCount(len(s.dataForWriting)) > maxBytes {
+		ret = s.dataForWriting[:maxBytes]
+		s.dataForWriting = s.dataForWriting[maxBytes:]
+	} else {
+		ret = s.dataForWriting
+		s.dataForWriting = nil
+		s.signalWrite()
+	}
+	s.writeOffset += protocol.ByteCount(len(ret))
+	s.flowController.AddBytesSent(protocol.ByteCount(len(ret)))
+	return ret, s.finishedWriting.Get() && s.dataForWriting == nil && !s.finSent.Get()
+}
+
+// popStreamFrame returns the next STREAM frame to send on this stream, of size at most
+// maxBytes. It prefers previously-lost frames queued by onLoss over new data, splitting
+// a lost frame if maxBytes is smaller than it. The returned frame counts towards
+// numOutstandingFrames until it is acked (onStreamFrameAcked) or lost again (onLoss).
+// It returns nil if there is nothing to send.
+func (s *sendStream) popStreamFrame(maxBytes protocol.ByteCount) *wire.StreamFrame {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// nothing should be sent for a stream that's been cancelled or reset: the peer has
+	// already been told (or will be) that it's torn down, so resending old data (even a
+	// previously-lost frame queued for retransmission) would be pointless at best
+	if s.err != nil {
+		return nil
+	}
+
+	if len(s.retransmissionQueue) > 0 {
+		return s.popRetransmissionLocked(maxBytes)
+	}
+
+	offset := s.writeOffset
+	data, shouldSendFin := s.getDataForWritingLocked(maxBytes)
+	if data == nil && !shouldSendFin {
+		return nil
+	}
+	if shouldSendFin {
+		s.finSent.Set(true)
+	}
+	frame := &wire.StreamFrame{
+		StreamID: s.streamID,
+		Offset:   offset,
+		Data:     data,
+		FinBit:   shouldSendFin,
+	}
+	s.numOutstandingFrames++
+	return frame
+}
+
+// popRetransmissionLocked returns the head of the retransmission queue, splitting it if
+// it doesn't fit into maxBytes. s.mutex must already be held.
+func (s *sendStream) popRetransmissionLocked(maxBytes protocol.ByteCount) *wire.StreamFrame {
+	frame := s.retransmissionQueue[0]
+	if protocol.ByteCount(len(frame.Data)) <= maxBytes {
+		s.retransmissionQueue = s.retransmissionQueue[1:]
+		s.numOutstandingFrames++
+		return frame
+	}
+	if maxBytes == 0 {
+		return nil
+	}
+	split := &wire.StreamFrame{
+		StreamID: frame.StreamID,
+		Offset:   frame.Offset,
+		Data:     frame.Data[:maxBytes],
+	}
+	frame.Data = frame.Data[maxBytes:]
+	frame.Offset += maxBytes
+	s.numOutstandingFrames++
+	return split
+}
+
+// Close implements io.Closer. It blocks until the FIN has been acknowledged
+// by the peer, or until the stream's Context is done (because it was reset
+// or cancelled) or its write deadline expires.
+func (s *sendStream) Close() error {
+	if err := s.CloseAsync(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	deadline := s.writeDeadline
+	s.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-s.ctx.Done():
+	case <-s.doneSending:
+	case <-timeout:
+		return errDeadline
+	}
+
+	s.mutex.Lock()
+	err := s.err
+	isError := s.cancelled.Get() || s.resetLocally.Get()
+	s.mutex.Unlock()
+	if isError {
+		return err
+	}
+	return nil
+}
+
+// CloseAsync closes the write-side of the stream without waiting for the FIN
+// to be acknowledged by the peer. Use Close if that acknowledgement is needed.
+func (s *sendStream) CloseAsync() error {
+	s.mutex.Lock()
+	alreadyClosed := s.finishedWriting.Get()
+	s.finishedWriting.Set(true)
+	s.mutex.Unlock()
+	if !alreadyClosed {
+		s.onData()
+	}
+	return nil
+}
+
+// signalFinAcked is called by the session's ack handler once the packet
+// carrying the final STREAM frame (the one with the FIN bit set) has been
+// acknowledged by the peer.
+func (s *sendStream) signalFinAcked() {
+	s.doneSendingOnce.Do(func() {
+		close(s.doneSending)
+		// the send side is now definitively closed, not just locally reset or
+		// cancelled; cancel ctx so it's done in this case too (as Context()'s
+		// doc comment promises), and so that anyone merging it into a larger
+		// context (e.g. the bidirectional stream's Context()) isn't left
+		// waiting on a context that will otherwise never fire.
+		s.ctxCancel()
+	})
+}
+
+// onStreamFrameAcked is the ack handler's entry point for reporting that a
+// STREAM frame sent on this stream has been acknowledged by the peer.
+func (s *sendStream) onStreamFrameAcked(frame *wire.StreamFrame) {
+	s.mutex.Lock()
+	s.numOutstandingFrames--
+	s.mutex.Unlock()
+	if frame.FinBit {
+		s.signalFinAcked()
+	}
+}
+
+// onLoss is called by the ack handler when a STREAM frame sent on this stream is reported
+// lost. It is requeued at the head of the retransmission queue, so popStreamFrame prefers
+// it over new data the next time it's called.
+func (s *sendStream) onLoss(frame *wire.StreamFrame) {
+	s.mutex.Lock()
+	s.numOutstandingFrames--
+	s.retransmissionQueue = append([]*wire.StreamFrame{frame}, s.retransmissionQueue...)
+	s.mutex.Unlock()
+	s.onData()
+}
+
+func (s *sendStream) shouldSendReset() bool {
+	if s.rstSent.Get() {
+		return false
+	}
+	return s.resetLocally.Get() && !s.finishedWriteAndSentFin()
+}
+
+// signalWrite performs a non-blocking send on the writeChan
+func (s *sendStream) signalWrite() {
+	select {
+	case s.writeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sendStream) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	oldDeadline := s.writeDeadline
+	s.writeDeadline = t
+	s.mutex.Unlock()
+	if t.Before(oldDeadline) {
+		s.signalWrite()
+	}
+	return nil
+}
+
+// Cancel is called by the session to indicate that an error occurred
+// The stream will be closed immediately.
+func (s *sendStream) Cancel(err error) {
+	s.mutex.Lock()
+	s.cancelled.Set(true)
+	s.ctxCancel()
+	// errors must not be changed!
+	if s.err == nil {
+		s.err = err
+		s.signalWrite()
+	}
+	s.mutex.Unlock()
+}
+
+// CancelWrite cancels the sending half of the stream.
+// The peer will be notified via a RST_STREAM carrying errorCode.
+func (s *sendStream) CancelWrite(errorCode uint64) error {
+	if s.resetLocally.Get() {
+		return nil
+	}
+	s.mutex.Lock()
+	s.resetLocally.Set(true)
+	s.ctxCancel()
+	// errors must not be changed!
+	if s.err == nil {
+		s.err = &StreamError{StreamID: s.streamID, ErrorCode: errorCode, Remote: false}
+		s.signalWrite()
+	}
+	if s.shouldSendReset() {
+		s.onReset(s.streamID, errorCode, s.writeOffset)
+		s.rstSent.Set(true)
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+// Reset cancels the sending half of the stream, sending a RST_STREAM with error code 0.
+//
+// Deprecated: use CancelWrite instead, which lets the caller choose the application error code.
+func (s *sendStream) Reset(err error) {
+	_ = s.CancelWrite(0)
+}
+
+// handleStopSendingFrame is called when a STOP_SENDING frame is received for this stream.
+// It cancels any pending Write calls, symmetrically to RegisterRemoteError on the receive side.
+func (s *sendStream) handleStopSendingFrame(frame *wire.StopSendingFrame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = &StreamError{StreamID: s.streamID, ErrorCode: frame.ErrorCode, Remote: true}
+	s.signalWrite()
+}
+
+func (s *sendStream) finishedWriteAndSentFin() bool {
+	return s.finishedWriting.Get() && s.finSent.Get()
+}
+
+// Finished tells the session whether this stream can be removed from its stream map.
+// It must not report completion before all STREAM frames, including the one carrying the
+// FIN, have actually been acked: otherwise a frame reported lost after cleanup would have
+// nowhere to be retransmitted from.
+func (s *sendStream) Finished() bool {
+	s.mutex.Lock()
+	noOutstandingFrames := s.numOutstandingFrames == 0 && len(s.retransmissionQueue) == 0
+	s.mutex.Unlock()
+	return s.cancelled.Get() ||
+		(s.finishedWriteAndSentFin() && noOutstandingFrames) ||
+		(s.resetLocally.Get() && s.rstSent.Get())
+}
+
+func (s *sendStream) UpdateSendWindow(n protocol.ByteCount) {
+	s.flowController.UpdateSendWindow(n)
+}
+
+func (s *sendStream) IsFlowControlBlocked() bool {
+	return s.flowController.IsBlocked()
+}
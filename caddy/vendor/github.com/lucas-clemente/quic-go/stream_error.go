@@ -0,0 +1,25 @@
+package quic
+
+import (
+	"fmt"
+
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+)
+
+// A StreamError is returned by Read and Write when the stream is canceled.
+// It carries the application-defined error code that was sent (or received)
+// on the wire, as either a RESET_STREAM or a STOP_SENDING frame.
+type StreamError struct {
+	StreamID  protocol.StreamID
+	ErrorCode uint64
+	// Remote is true if the error code was received from the peer.
+	// It is false if the error was produced locally, e.g. by calling CancelRead or CancelWrite.
+	Remote bool
+}
+
+func (e *StreamError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("stream %d was reset by the peer with error code %d", e.StreamID, e.ErrorCode)
+	}
+	return fmt.Sprintf("stream %d was canceled with error code %d", e.StreamID, e.ErrorCode)
+}
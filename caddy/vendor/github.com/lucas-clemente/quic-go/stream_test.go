@@ -0,0 +1,223 @@
+package quic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+	"github.com/lucas-clemente/quic-go/internal/wire"
+)
+
+// mockStreamFlowController is a bare-bones stand-in for
+// flowcontrol.StreamFlowController that imposes no limits, for tests that
+// only care about sendStream/receiveStream's own bookkeeping.
+type mockStreamFlowController struct{}
+
+func (mockStreamFlowController) SendWindowSize() protocol.ByteCount  { return 1 << 30 }
+func (mockStreamFlowController) AddBytesSent(protocol.ByteCount)     {}
+func (mockStreamFlowController) UpdateSendWindow(protocol.ByteCount) {}
+func (mockStreamFlowController) IsBlocked() bool                     { return false }
+func (mockStreamFlowController) AddBytesRead(protocol.ByteCount)     {}
+func (mockStreamFlowController) GetWindowUpdate() protocol.ByteCount { return 0 }
+func (mockStreamFlowController) UpdateHighestReceived(protocol.ByteCount, bool) error {
+	return nil
+}
+
+func newTestSendStream() *sendStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return newSendStream(1, func() {}, func(protocol.StreamID, uint64, protocol.ByteCount) {}, mockStreamFlowController{}, protocol.VersionWhatever, ctx, cancel)
+}
+
+func newTestReceiveStream() *receiveStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return newReceiveStream(1, func() {}, func(protocol.StreamID, uint64) {}, mockStreamFlowController{}, protocol.VersionWhatever, ctx, cancel)
+}
+
+// TestCancelReadReleasesBufferedFrames checks that CancelRead returns the
+// buffers of any already-buffered frames to their pool instead of just
+// dropping them, per review feedback on chunk0-2.
+func TestCancelReadReleasesBufferedFrames(t *testing.T) {
+	s := newTestReceiveStream()
+	released := false
+	if err := s.AddStreamFrame(&wire.StreamFrame{
+		Offset:  0,
+		Data:    []byte("foobar"),
+		PutBack: func() { released = true },
+	}); err != nil {
+		t.Fatalf("AddStreamFrame: %v", err)
+	}
+
+	if err := s.CancelRead(1234); err != nil {
+		t.Fatalf("CancelRead: %v", err)
+	}
+	if !released {
+		t.Fatal("CancelRead did not release the buffer of the already-buffered frame")
+	}
+}
+
+// TestCancelReadDoesNotReleaseLastReadFrame checks that CancelRead leaves the
+// buffer behind the chunk most recently handed out by ReadFrame alone: that
+// chunk may still be in use by another goroutine (CancelRead is meant to be
+// callable concurrently to interrupt an in-progress read), so only a later
+// ReadFrame call — never CancelRead — may release it.
+func TestCancelReadDoesNotReleaseLastReadFrame(t *testing.T) {
+	s := newTestReceiveStream()
+	released := false
+	if err := s.AddStreamFrame(&wire.StreamFrame{
+		Offset:  0,
+		Data:    []byte("foobar"),
+		PutBack: func() { released = true },
+	}); err != nil {
+		t.Fatalf("AddStreamFrame: %v", err)
+	}
+	if _, _, err := s.ReadFrame(); err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+
+	if err := s.CancelRead(1234); err != nil {
+		t.Fatalf("CancelRead: %v", err)
+	}
+	if released {
+		t.Fatal("CancelRead released the buffer of the most recently read frame while a concurrent reader might still be using it")
+	}
+}
+
+// TestReadFrameReleasesFinalChunkImmediately checks that ReadFrame releases
+// the FIN-carrying chunk's buffer as part of returning it, since callers
+// won't make a further call to release it on, per review feedback on chunk0-6.
+func TestReadFrameReleasesFinalChunkImmediately(t *testing.T) {
+	s := newTestReceiveStream()
+	released := false
+	if err := s.AddStreamFrame(&wire.StreamFrame{
+		Offset:  0,
+		Data:    []byte("foobar"),
+		FinBit:  true,
+		PutBack: func() { released = true },
+	}); err != nil {
+		t.Fatalf("AddStreamFrame: %v", err)
+	}
+
+	if _, fin, err := s.ReadFrame(); !fin || err == nil {
+		t.Fatalf("expected the FIN chunk and io.EOF, got fin=%v err=%v", fin, err)
+	}
+	if !released {
+		t.Fatal("ReadFrame did not release the final chunk's buffer")
+	}
+}
+
+// TestCancelWriteSendsResetOnlyOnce checks that calling CancelWrite twice
+// only triggers one RST_STREAM.
+func TestCancelWriteSendsResetOnlyOnce(t *testing.T) {
+	resets := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSendStream(1, func() {}, func(protocol.StreamID, uint64, protocol.ByteCount) {}, mockStreamFlowController{}, protocol.VersionWhatever, ctx, cancel)
+	s.onReset = func(protocol.StreamID, uint64, protocol.ByteCount) { resets++ }
+
+	if err := s.CancelWrite(42); err != nil {
+		t.Fatalf("CancelWrite: %v", err)
+	}
+	if err := s.CancelWrite(42); err != nil {
+		t.Fatalf("CancelWrite: %v", err)
+	}
+	if resets != 1 {
+		t.Fatalf("expected exactly one RST_STREAM, got %d", resets)
+	}
+}
+
+// TestCloseWaitsForFinAcked checks that Close blocks until signalFinAcked is
+// called, rather than returning as soon as the FIN has been sent.
+func TestCloseWaitsForFinAcked(t *testing.T) {
+	s := newTestSendStream()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Close() }()
+
+	select {
+	case <-done:
+		t.Fatal("Close returned before the FIN was acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.signalFinAcked()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the FIN was acknowledged")
+	}
+}
+
+// TestOnLossRequeuesForRetransmission checks that a frame reported lost by
+// onLoss is handed back out, ahead of new data, by a later popStreamFrame.
+func TestOnLossRequeuesForRetransmission(t *testing.T) {
+	s := newTestSendStream()
+	lost := &wire.StreamFrame{StreamID: 1, Offset: 0, Data: []byte("foobar")}
+
+	s.onLoss(lost)
+
+	frame := s.popStreamFrame(1000)
+	if frame != lost {
+		t.Fatalf("expected popStreamFrame to return the retransmission-queued frame, got %+v", frame)
+	}
+}
+
+// TestPopStreamFrameNilAfterCancelWrite checks that popStreamFrame returns
+// nil once the stream has been cancelled, even when a frame is still sitting
+// in the retransmission queue: the peer has already torn the stream down, so
+// there's nothing left to (re)send.
+func TestPopStreamFrameNilAfterCancelWrite(t *testing.T) {
+	s := newTestSendStream()
+	s.onLoss(&wire.StreamFrame{StreamID: 1, Offset: 0, Data: []byte("foobar")})
+
+	if err := s.CancelWrite(1); err != nil {
+		t.Fatalf("CancelWrite: %v", err)
+	}
+
+	if frame := s.popStreamFrame(1000); frame != nil {
+		t.Fatalf("expected popStreamFrame to return nil after CancelWrite, got %+v", frame)
+	}
+}
+
+// TestUniStreamIDGeneratorEncodesDirection checks that the IDs a
+// uniStreamIDGenerator hands out are all recognized as unidirectional, and
+// are spaced correctly so the low bits stay fixed.
+func TestUniStreamIDGeneratorEncodesDirection(t *testing.T) {
+	g := newUniStreamIDGenerator(protocol.PerspectiveClient)
+	first := g.Next()
+	second := g.Next()
+
+	if !isUniStreamID(first) || !isUniStreamID(second) {
+		t.Fatalf("expected both IDs to be unidirectional, got %d and %d", first, second)
+	}
+	if second-first != 4 {
+		t.Fatalf("expected consecutive unidirectional stream IDs to be spaced by 4, got %d and %d", first, second)
+	}
+}
+
+// TestNewSendOnlyAndReceiveOnlyStreams checks that the two halves of a
+// unidirectional stream returned by newSendOnlyStream/newReceiveOnlyStream
+// only expose the side the application is allowed to use, and that each
+// still behaves like its bidirectional counterpart.
+func TestNewSendOnlyAndReceiveOnlyStreams(t *testing.T) {
+	id := newUniStreamIDGenerator(protocol.PerspectiveClient).Next()
+
+	send := newSendOnlyStream(id, func() {}, func(protocol.StreamID, uint64, protocol.ByteCount) {}, mockStreamFlowController{}, protocol.VersionWhatever)
+	if send.StreamID() != id {
+		t.Fatalf("expected send-only stream to keep its ID, got %d", send.StreamID())
+	}
+	if err := send.CancelWrite(1); err != nil {
+		t.Fatalf("CancelWrite on a send-only stream: %v", err)
+	}
+
+	receive := newReceiveOnlyStream(id, func() {}, func(protocol.StreamID, uint64) {}, mockStreamFlowController{}, protocol.VersionWhatever)
+	if receive.StreamID() != id {
+		t.Fatalf("expected receive-only stream to keep its ID, got %d", receive.StreamID())
+	}
+	if err := receive.CancelRead(1); err != nil {
+		t.Fatalf("CancelRead on a receive-only stream: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package quic
+
+// This file provides the primitives a session's streams manager needs to open and
+// accept unidirectional streams: ID-direction encoding (isUniStreamID), ID allocation
+// for locally-opened streams (uniStreamIDGenerator), and constructors that hand back
+// only the half of the stream the application is allowed to use (newSendOnlyStream,
+// newReceiveOnlyStream). This vendor snapshot doesn't include session.go, so wiring
+// these into OpenUniStream/AcceptUniStream is left to whatever session type embeds it.
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/internal/flowcontrol"
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+)
+
+// isUniStreamID reports whether id, per the QUIC transport spec, identifies a
+// unidirectional stream. The second-lowest bit of a stream ID encodes the
+// direction (0 = bidirectional, 1 = unidirectional); the lowest bit encodes
+// the initiator, which isUniStreamID doesn't care about.
+func isUniStreamID(id protocol.StreamID) bool {
+	return id&0x2 != 0
+}
+
+// newSendOnlyStream creates a send-only stream: the unidirectional stream
+// this endpoint opens itself (e.g. an HTTP/3 request or control stream).
+// Unlike newStream, it doesn't pair the send side with a receiveStream: the
+// peer only ever sees the ReceiveStream half, created by newReceiveOnlyStream
+// once the first STREAM frame for this ID arrives.
+func newSendOnlyStream(
+	streamID protocol.StreamID,
+	onData func(),
+	onReset func(protocol.StreamID, uint64, protocol.ByteCount),
+	flowController flowcontrol.StreamFlowController,
+	version protocol.VersionNumber,
+) SendStream {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	return newSendStream(streamID, onData, onReset, flowController, version, ctx, ctxCancel)
+}
+
+// newReceiveOnlyStream creates a receive-only stream: the half of a
+// unidirectional stream the peer opened that this endpoint is allowed to use.
+// There's no corresponding SendStream on this side, since the stream ID's
+// direction bit marks it as send-only for whichever endpoint initiated it.
+func newReceiveOnlyStream(
+	streamID protocol.StreamID,
+	onData func(),
+	onStopSending func(protocol.StreamID, uint64),
+	flowController flowcontrol.StreamFlowController,
+	version protocol.VersionNumber,
+) ReceiveStream {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	return newReceiveStream(streamID, onData, onStopSending, flowController, version, ctx, ctxCancel)
+}
+
+// uniStreamIDGenerator hands out the stream IDs the streams manager uses when
+// this endpoint opens a new unidirectional stream. IDs are spaced by 4: the
+// low two bits are reserved by the QUIC transport spec for the initiator and
+// direction, and stay fixed for every ID a given generator produces.
+type uniStreamIDGenerator struct {
+	mutex sync.Mutex
+	next  protocol.StreamID
+}
+
+func newUniStreamIDGenerator(perspective protocol.Perspective) *uniStreamIDGenerator {
+	first := protocol.StreamID(0x2) // unidirectional, client-initiated
+	if perspective == protocol.PerspectiveServer {
+		first = protocol.StreamID(0x3) // unidirectional, server-initiated
+	}
+	return &uniStreamIDGenerator{next: first}
+}
+
+// Next returns the next unidirectional stream ID this endpoint should use to
+// open a new stream.
+func (g *uniStreamIDGenerator) Next() protocol.StreamID {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	id := g.next
+	g.next += 4
+	return id
+}